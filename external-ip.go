@@ -1,93 +1,85 @@
 package externalip
 
 import (
-	"io/ioutil"
+	"context"
 	"net"
 	"net/http"
-	"strings"
+	"net/netip"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
-var queriers = []func() string{
-	GoogleDNS,
-	OpenDNS,
-	AkamaiDNS,
-}
+// Family identifies an IP address family to resolve an external address for.
+type Family int
 
-// DNS queries all DNS based external IP resolvers in parallel and
-// produces a result if there is a quorum - at least half of the results
-// are the same.
-func DNS() string {
-	// Run the DNS queries in a goroutine, channeling the results into ch
-	ch := make(chan string)
-	for _, f := range queriers {
-		go func(f func() string) {
-			ch <- f()
-		}(f)
-	}
-	// Receive the results from the queries from ch and produce a result
-	// if more than half of them concur.
-	result := make(chan string)
-	go func() {
-		ips := make(map[string]int)
-		done := false
-		for range queriers {
-			ip := <-ch
-			ips[ip]++
-			if !done && ips[ip] > len(queriers)/2 {
-				result <- ip
-				done = true
-			}
-		}
-		close(result)
-	}()
-	return <-result
-}
+const (
+	// FamilyIPv4 resolves the external IPv4 address, querying providers
+	// over IPv4-only transports.
+	FamilyIPv4 Family = iota
+	// FamilyIPv6 resolves the external IPv6 address, querying providers
+	// over IPv6-only transports.
+	FamilyIPv6
+)
 
-// GoogleDNS queries Google Public DNS for the external IP address
-func GoogleDNS() (ip string) {
-	msg := new(dns.Msg)
-	msg.SetQuestion("o-o.myaddr.l.google.com.", dns.TypeTXT)
-	in, err := dns.Exchange(msg, "ns1.google.com:53")
-	if err != nil {
-		return
+// network returns the UDP network name used to pin a DNS query to this
+// family.
+func (f Family) network() string {
+	if f == FamilyIPv6 {
+		return "udp6"
 	}
-	if t, ok := in.Answer[0].(*dns.TXT); ok {
-		ip = net.ParseIP(t.Txt[0]).To4().String()
+	return "udp4"
+}
+
+func (f Family) String() string {
+	if f == FamilyIPv6 {
+		return "IPv6"
 	}
-	return
+	return "IPv4"
 }
 
-// OpenDNS queries Open DNS for the external IP address
-func OpenDNS() (ip string) {
-	msg := new(dns.Msg)
-	msg.SetQuestion("myip.opendns.com.", dns.TypeA)
-	in, err := dns.Exchange(msg, "resolver1.opendns.com:53")
-	if err != nil {
-		return
+// defaultTimeout bounds each individual resolver query issued by DNS,
+// HTTP, DNSFamily, HTTPFamily and Both.
+const defaultTimeout = 10 * time.Second
+
+// dnsResolvers builds the default DNS providers for a family. OpenDNS is
+// queried over DNS-over-TLS, authenticated against the name their DoT
+// service actually presents a certificate for ("dns.opendns.com"), rather
+// than the plaintext resolver hostname. Google's ns1.google.com and
+// Akamai's ns1-1.akamaitech.net are authoritative nameservers for their
+// myip zones only and do not speak DoT, so they stay on TransportUDP;
+// losing either of those to a failure still leaves a majority among the
+// three IPv4 providers.
+//
+// Only two independent IPv6 sources exist (OpenDNS over DoT and Google
+// plaintext), so dnsQuorum requires both to agree for that family -
+// otherwise the single unauthenticated, spoofable Google answer could be
+// returned as "consensus" on its own, which would defeat the point of
+// authenticating the DNS transport at all.
+func dnsResolvers(family Family) []Resolver {
+	if family == FamilyIPv6 {
+		return []Resolver{
+			DNSResolver{Server: "resolver1.ipv6-sandbox.opendns.com:853", Question: "myip.opendns.com.", Type: dns.TypeAAAA, Family: family, Transport: TransportDoT, TLSServerName: "dns.opendns.com"},
+			DNSResolver{Server: "ns1.google.com:53", Question: "o-o.myaddr.l.google.com.", Type: dns.TypeTXT, Family: family},
+		}
 	}
-	if a, ok := in.Answer[0].(*dns.A); ok {
-		ip = a.A.To4().String()
+	return []Resolver{
+		DNSResolver{Server: "resolver1.opendns.com:853", Question: "myip.opendns.com.", Type: dns.TypeA, Family: family, Transport: TransportDoT, TLSServerName: "dns.opendns.com"},
+		DNSResolver{Server: "ns1.google.com:53", Question: "o-o.myaddr.l.google.com.", Type: dns.TypeTXT, Family: family},
+		DNSResolver{Server: "ns1-1.akamaitech.net:53", Question: "whoami.akamai.net.", Type: dns.TypeA, Family: family},
 	}
-	return
 }
 
-// AkamaiDNS queries Akamai DNS for the external IP address
-func AkamaiDNS() (ip string) {
-	msg := new(dns.Msg)
-	msg.SetQuestion("whoami.akamai.net.", dns.TypeA)
-	in, err := dns.Exchange(msg, "ns1-1.akamaitech.net:53")
-	if err != nil {
-		return
+// dnsQuorum returns the Consensus quorum to require across dnsResolvers
+// for family. See dnsResolvers for why IPv6 needs unanimous agreement.
+func dnsQuorum(family Family) float64 {
+	if family == FamilyIPv6 {
+		return 1.0
 	}
-	if a, ok := in.Answer[0].(*dns.A); ok {
-		ip = a.A.To4().String()
-	}
-	return
+	return 0
 }
 
-var urls = []string{
+var urls4 = []string{
 	"http://v4.ident.me/",
 	"http://whatismyip.akamai.com/",
 	"http://checkip.amazonaws.com/",
@@ -108,44 +100,149 @@ var urls = []string{
 	"https://wtfismyip.com/text",
 }
 
+var urls6 = []string{
+	"https://v6.ident.me/",
+	"https://api6.ipify.org/",
+	"https://icanhazip.com",
+}
+
+func httpResolvers(family Family) []Resolver {
+	urls := urls4
+	if family == FamilyIPv6 {
+		urls = urls6
+	}
+	client := httpClient(family)
+	resolvers := make([]Resolver, len(urls))
+	for i, url := range urls {
+		resolvers[i] = HTTPResolver{URL: url, Client: client, Family: family}
+	}
+	return resolvers
+}
+
+// PerInterface enumerates non-loopback, up network interfaces and
+// returns the external IPv4 address each one sees, keyed by interface
+// name. This is useful for failover and multi-WAN routers that need to
+// tell their egress paths apart.
+func PerInterface() map[string]netip.Addr {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	type found struct {
+		name string
+		addr netip.Addr
+	}
+	ch := make(chan found, len(ifaces))
+	n := 0
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		n++
+		go func(iface net.Interface) {
+			resolvers := make([]Resolver, len(urls4))
+			for i, url := range urls4 {
+				resolvers[i] = HTTPResolver{URL: url, Family: FamilyIPv4, Interface: &iface}
+			}
+			c := &Consensus{Resolvers: resolvers, Timeout: defaultTimeout}
+			addr, _ := c.Resolve(context.Background())
+			ch <- found{iface.Name, addr}
+		}(iface)
+	}
+
+	out := make(map[string]netip.Addr)
+	for i := 0; i < n; i++ {
+		f := <-ch
+		if f.addr.IsValid() {
+			out[f.name] = f.addr
+		}
+	}
+	return out
+}
+
+func httpClient(family Family) *http.Client {
+	network := "tcp4"
+	if family == FamilyIPv6 {
+		network = "tcp6"
+	}
+	dialer := &net.Dialer{Timeout: defaultTimeout}
+	return &http.Client{
+		Timeout: defaultTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+// DNSFamily queries all DNS based external IP resolvers for the given
+// family and returns the address on which a quorum of them agrees.
+func DNSFamily(family Family) string {
+	c := &Consensus{Resolvers: dnsResolvers(family), Quorum: dnsQuorum(family), Timeout: defaultTimeout}
+	addr, _ := c.Resolve(context.Background())
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.String()
+}
+
+// DNS queries all DNS based external IP resolvers in parallel and
+// produces a result if there is a quorum - at least half of the results
+// are the same.
+func DNS() string {
+	return DNSFamily(FamilyIPv4)
+}
+
+// HTTPFamily queries all HTTP based external IP resolvers for the given
+// family, over a transport dialing out on that family only, and returns
+// the address on which a quorum of them agrees.
+func HTTPFamily(family Family) string {
+	c := &Consensus{Resolvers: httpResolvers(family), Timeout: defaultTimeout}
+	addr, _ := c.Resolve(context.Background())
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.String()
+}
+
 // HTTP queries all HTTP based external IP resolvers in parallel and
 // produces a result if there is a quorum - at least half of the results
 // are the same.
 func HTTP() string {
-	// Run the web queries in a goroutine, channeling the result into ch
-	ch := make(chan string)
-	for _, url := range urls {
-		go func(url string) {
-			ch <- urlGetReadAll(url)
-		}(url)
-	}
-	result := make(chan string)
-	go func() {
-		ips := make(map[string]int)
-		done := false
-		for range urls {
-			ip := <-ch
-			ips[ip]++
-			if !done && ips[ip] > len(urls)/2 {
-				result <- ip
-				done = true
-			}
-		}
-		close(result)
-	}()
-	return <-result
+	return HTTPFamily(FamilyIPv4)
 }
 
-func urlGetReadAll(url string) (ip string) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return
+// Both queries DNS and HTTP based external IP resolvers over both
+// IPv4-only and IPv6-only transports and returns the address seen on
+// each family. Either value is empty if no quorum was reached for that
+// family.
+func Both() (v4, v6 string) {
+	type out struct {
+		family Family
+		ip     string
+	}
+	ch := make(chan out, 2)
+	for _, family := range []Family{FamilyIPv4, FamilyIPv6} {
+		go func(family Family) {
+			ch <- out{family, familyResult(family)}
+		}(family)
+	}
+	for i := 0; i < 2; i++ {
+		o := <-ch
+		if o.family == FamilyIPv6 {
+			v6 = o.ip
+		} else {
+			v4 = o.ip
+		}
 	}
-	defer resp.Body.Close()
+	return
+}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
+func familyResult(family Family) string {
+	if ip := DNSFamily(family); ip != "" {
+		return ip
 	}
-	return strings.TrimSpace(string(bytes))
+	return HTTPFamily(family)
 }
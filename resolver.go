@@ -0,0 +1,401 @@
+package externalip
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Resolver resolves the external IP address as reported by a single
+// provider.
+type Resolver interface {
+	Resolve(ctx context.Context) (netip.Addr, error)
+}
+
+// ResolverError records the failure of a single Resolver queried as part
+// of a Consensus, so callers can inspect which providers were unreachable
+// or returned no address rather than only seeing the aggregate failure.
+// A provider that returned a valid but different address is not recorded.
+type ResolverError struct {
+	Resolver Resolver
+	Err      error
+}
+
+func (e *ResolverError) Error() string {
+	return fmt.Sprintf("externalip: %v: %v", e.Resolver, e.Err)
+}
+
+func (e *ResolverError) Unwrap() error {
+	return e.Err
+}
+
+// Consensus queries a set of Resolvers in parallel and returns the
+// address reported by at least Quorum of them, cancelling the resolvers
+// still in flight once that happens.
+type Consensus struct {
+	Resolvers []Resolver
+	// Quorum is the fraction of Resolvers, in (0, 1], that must agree on
+	// an address before it is returned, rounded up - e.g. 1.0 requires
+	// unanimous agreement. Note that an explicit 0.5 only requires at
+	// least half to agree; for an even Resolver count that is not a
+	// majority. Zero defaults to requiring a strict majority (more than
+	// half), matching this package's pre-Consensus behavior.
+	Quorum float64
+	// Timeout bounds each individual Resolver query. Zero means a
+	// resolver is only bounded by the context passed to Resolve.
+	Timeout time.Duration
+}
+
+type consensusResult struct {
+	addr netip.Addr
+	err  error
+	r    Resolver
+}
+
+// Resolve runs every Resolver concurrently and returns as soon as quorum
+// is reached. Results are delivered over a channel buffered to the number
+// of Resolvers, so resolvers still in flight after quorum or cancellation
+// never block trying to send. Errors and empty results are excluded from
+// the quorum tally and returned alongside so callers can tell a failing
+// provider from one that agrees.
+func (c *Consensus) Resolve(ctx context.Context) (netip.Addr, []ResolverError) {
+	var need int
+	if c.Quorum <= 0 {
+		need = len(c.Resolvers)/2 + 1
+	} else {
+		need = int(math.Ceil(float64(len(c.Resolvers)) * c.Quorum))
+	}
+	if need < 1 {
+		need = 1
+	}
+	if need > len(c.Resolvers) {
+		need = len(c.Resolvers)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan consensusResult, len(c.Resolvers))
+	for _, r := range c.Resolvers {
+		go func(r Resolver) {
+			rctx := ctx
+			if c.Timeout > 0 {
+				var rcancel context.CancelFunc
+				rctx, rcancel = context.WithTimeout(ctx, c.Timeout)
+				defer rcancel()
+			}
+			addr, err := r.Resolve(rctx)
+			ch <- consensusResult{addr, err, r}
+		}(r)
+	}
+
+	counts := make(map[netip.Addr]int)
+	var errs []ResolverError
+	for i := 0; i < len(c.Resolvers); i++ {
+		res := <-ch
+		if res.err != nil || !res.addr.IsValid() {
+			if res.err == nil {
+				res.err = errors.New("empty result")
+			}
+			errs = append(errs, ResolverError{Resolver: res.r, Err: res.err})
+			continue
+		}
+		counts[res.addr]++
+		if counts[res.addr] >= need {
+			return res.addr, errs
+		}
+	}
+	return netip.Addr{}, errs
+}
+
+// Transport selects the wire protocol a DNSResolver uses to reach its
+// server.
+type Transport int
+
+const (
+	// TransportUDP sends a plaintext query over UDP, pinned to the
+	// resolver's Family. It is trivially spoofed or hijacked on a
+	// hostile network or by a meddling resolver.
+	TransportUDP Transport = iota
+	// TransportDoT sends the query over DNS-over-TLS (RFC 7858) to
+	// Server, e.g. "1.1.1.1:853", authenticating the server against
+	// TLSServerName.
+	TransportDoT
+	// TransportDoH sends the query as a POST of the wire-format message
+	// to Server, which must be a "/dns-query" URL, e.g.
+	// "https://dns.google/dns-query".
+	TransportDoH
+)
+
+// DNSResolver resolves the external IP address by sending a single
+// question to a DNS server and parsing the address out of the first
+// answer record.
+type DNSResolver struct {
+	// Server is the "host:port" of the DNS server to query, or for
+	// TransportDoH the full "/dns-query" URL.
+	Server string
+	// Question is the domain name being asked about.
+	Question string
+	// Type is the DNS record type expected in the answer, e.g.
+	// dns.TypeA, dns.TypeAAAA or dns.TypeTXT.
+	Type uint16
+	// Family pins the query to an IPv4-only or IPv6-only transport.
+	Family Family
+	// Transport selects the wire protocol. Zero value is TransportUDP.
+	Transport Transport
+	// TLSServerName overrides the name used to authenticate the
+	// server's certificate for TransportDoT and TransportDoH. Defaults
+	// to the host part of Server when empty.
+	TLSServerName string
+	// LocalAddr binds the query to this local address, e.g. to pick an
+	// egress interface or source address on a multi-homed host. Takes
+	// precedence over Interface.
+	LocalAddr net.Addr
+	// Interface binds the query to the first address of Family found on
+	// iface. Ignored if LocalAddr is set.
+	Interface *net.Interface
+}
+
+func (d DNSResolver) String() string {
+	return fmt.Sprintf("dns:%s?%s", d.Server, d.Question)
+}
+
+// Resolve implements Resolver.
+func (d DNSResolver) Resolve(ctx context.Context) (netip.Addr, error) {
+	// TransportDoT and TransportDoH dial over TCP; only plain TransportUDP
+	// dials over UDP.
+	network := "tcp"
+	if d.Transport == TransportUDP {
+		network = "udp"
+	}
+	local, err := bindLocalAddr(d.LocalAddr, d.Interface, d.Family, network)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(d.Question), d.Type)
+
+	var in *dns.Msg
+	switch d.Transport {
+	case TransportDoT:
+		in, err = d.exchangeDoT(ctx, msg, local)
+	case TransportDoH:
+		in, err = d.exchangeDoH(ctx, msg, local)
+	default:
+		client := &dns.Client{Net: d.Family.network()}
+		if local != nil {
+			client.Dialer = &net.Dialer{LocalAddr: local}
+		}
+		in, _, err = client.ExchangeContext(ctx, msg, d.Server)
+	}
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if in == nil || len(in.Answer) == 0 {
+		return netip.Addr{}, fmt.Errorf("no answer from %s", d.Server)
+	}
+	switch rr := in.Answer[0].(type) {
+	case *dns.A:
+		return addrFromIP(rr.A)
+	case *dns.AAAA:
+		return addrFromIP(rr.AAAA)
+	case *dns.TXT:
+		if len(rr.Txt) == 0 {
+			return netip.Addr{}, fmt.Errorf("empty TXT answer from %s", d.Server)
+		}
+		return netip.ParseAddr(rr.Txt[0])
+	default:
+		return netip.Addr{}, fmt.Errorf("unexpected answer type from %s", d.Server)
+	}
+}
+
+// exchangeDoT sends msg over a TLS connection dialed on an IPv4-only or
+// IPv6-only network per d.Family, then reads the response off the same
+// connection using the standard TCP-style length-prefixed framing.
+func (d DNSResolver) exchangeDoT(ctx context.Context, msg *dns.Msg, local net.Addr) (*dns.Msg, error) {
+	network := "tcp4"
+	if d.Family == FamilyIPv6 {
+		network = "tcp6"
+	}
+	rawConn, err := (&net.Dialer{LocalAddr: local}).DialContext(ctx, network, d.Server)
+	if err != nil {
+		return nil, err
+	}
+	serverName := d.TLSServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(d.Server)
+	}
+	tlsConn := tls.Client(rawConn, &tls.Config{ServerName: serverName})
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+	conn := &dns.Conn{Conn: tlsConn}
+	defer conn.Close()
+	if err := conn.WriteMsg(msg); err != nil {
+		return nil, err
+	}
+	return conn.ReadMsg()
+}
+
+// exchangeDoH POSTs the wire-format msg to d.Server, which must be a
+// "/dns-query" endpoint, per RFC 8484.
+func (d DNSResolver) exchangeDoH(ctx context.Context, msg *dns.Msg, local net.Addr) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Server, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	client := httpClient(d.Family)
+	if local != nil {
+		client = withLocalAddr(client, d.Family, local)
+	}
+	if d.TLSServerName != "" {
+		if t, ok := client.Transport.(*http.Transport); ok {
+			t.TLSClientConfig = &tls.Config{ServerName: d.TLSServerName}
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+func addrFromIP(ip net.IP) (netip.Addr, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("invalid address %v", ip)
+	}
+	return addr.Unmap(), nil
+}
+
+// bindLocalAddr resolves the local address a query should be dialed from.
+// explicit takes precedence; otherwise the first address of family found
+// on iface is used, typed for network ("tcp" or "udp"). Returns a nil
+// net.Addr, with no error, if neither is set.
+func bindLocalAddr(explicit net.Addr, iface *net.Interface, family Family, network string) (net.Addr, error) {
+	if explicit != nil {
+		return explicit, nil
+	}
+	if iface == nil {
+		return nil, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("externalip: addresses of %s: %w", iface.Name, err)
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if isIPv4 := ipNet.IP.To4() != nil; isIPv4 == (family == FamilyIPv6) {
+			continue
+		}
+		if network == "tcp" {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+		return &net.UDPAddr{IP: ipNet.IP}, nil
+	}
+	return nil, fmt.Errorf("externalip: no %v address on interface %s", family, iface.Name)
+}
+
+// withLocalAddr returns a client with base's Timeout that dials from local
+// on the tcp4 or tcp6 network for family. Nothing else of base, including
+// its Transport, is carried over.
+func withLocalAddr(base *http.Client, family Family, local net.Addr) *http.Client {
+	network := "tcp4"
+	if family == FamilyIPv6 {
+		network = "tcp6"
+	}
+	dialer := &net.Dialer{Timeout: base.Timeout, LocalAddr: local}
+	return &http.Client{
+		Timeout: base.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+// HTTPResolver resolves the external IP address by fetching a URL whose
+// body is expected to contain nothing but the address.
+type HTTPResolver struct {
+	URL string
+	// Client is used to perform the request. A nil Client uses the
+	// default client for Family. When LocalAddr or Interface is set,
+	// only Client's Timeout is kept; see withLocalAddr.
+	Client *http.Client
+	// Family is used to pick a default Client and, together with
+	// Interface, to select a same-family local address. When LocalAddr
+	// or Interface is set it also pins the request to tcp4 or tcp6.
+	// It does not need to be set when a Client is provided and neither
+	// LocalAddr nor Interface is.
+	Family Family
+	// LocalAddr binds the request to this local address, e.g. to pick
+	// an egress interface or source address on a multi-homed host.
+	// Takes precedence over Interface.
+	LocalAddr net.Addr
+	// Interface binds the request to the first address of Family found
+	// on iface. Ignored if LocalAddr is set.
+	Interface *net.Interface
+}
+
+func (h HTTPResolver) String() string {
+	return fmt.Sprintf("http:%s", h.URL)
+}
+
+// Resolve implements Resolver.
+func (h HTTPResolver) Resolve(ctx context.Context) (netip.Addr, error) {
+	client := h.Client
+	if client == nil {
+		client = httpClient(h.Family)
+	}
+	if local, err := bindLocalAddr(h.LocalAddr, h.Interface, h.Family, "tcp"); err != nil {
+		return netip.Addr{}, err
+	} else if local != nil {
+		client = withLocalAddr(client, h.Family, local)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.ParseAddr(strings.TrimSpace(string(body)))
+}
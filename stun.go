@@ -0,0 +1,220 @@
+package externalip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// stunMagicCookie is the fixed STUN magic cookie defined by RFC 5389,
+// used both to identify STUN messages on the wire and to XOR-obfuscate
+// the XOR-MAPPED-ADDRESS attribute.
+const stunMagicCookie = 0x2112A442
+
+const (
+	stunBindingRequest       = 0x0001
+	stunBindingSuccessResp   = 0x0101
+	stunAttrXorMappedAddress = 0x0020
+	stunFamilyIPv4           = 0x01
+	stunFamilyIPv6           = 0x02
+	stunHeaderLen            = 20
+)
+
+var stunServers = []string{
+	"stun.l.google.com:19302",
+	"stun.cloudflare.com:3478",
+	"stun.nextcloud.com:443",
+}
+
+// STUNResolver resolves the external IP address by sending an RFC 5389
+// STUN binding request to a STUN server and reading back the
+// XOR-MAPPED-ADDRESS attribute of the response. Unlike the DNS and HTTP
+// resolvers, it reports the address as seen by NAT traversal, which can
+// still succeed where outbound DNS or HTTP is filtered.
+type STUNResolver struct {
+	// Server is the "host:port" of the STUN server to query.
+	Server string
+	// Family pins the query to an IPv4-only or IPv6-only transport.
+	Family Family
+}
+
+func (s STUNResolver) String() string {
+	return fmt.Sprintf("stun:%s", s.Server)
+}
+
+// Resolve implements Resolver.
+func (s STUNResolver) Resolve(ctx context.Context) (netip.Addr, error) {
+	network := "udp4"
+	if s.Family == FamilyIPv6 {
+		network = "udp6"
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, s.Server)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	txID := make([]byte, 12)
+	if _, err := rand.Read(txID); err != nil {
+		return netip.Addr{}, err
+	}
+	req := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(req[2:4], 0) // no attributes
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	copy(req[8:20], txID)
+
+	if _, err := conn.Write(req); err != nil {
+		return netip.Addr{}, err
+	}
+
+	buf := make([]byte, 548)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return parseStunBindingResponse(buf[:n], txID)
+}
+
+func parseStunBindingResponse(resp, txID []byte) (netip.Addr, error) {
+	if len(resp) < stunHeaderLen {
+		return netip.Addr{}, fmt.Errorf("stun: short response (%d bytes)", len(resp))
+	}
+	msgType := binary.BigEndian.Uint16(resp[0:2])
+	msgLen := binary.BigEndian.Uint16(resp[2:4])
+	cookie := binary.BigEndian.Uint32(resp[4:8])
+	if msgType != stunBindingSuccessResp {
+		return netip.Addr{}, fmt.Errorf("stun: unexpected message type 0x%04x", msgType)
+	}
+	if cookie != stunMagicCookie {
+		return netip.Addr{}, fmt.Errorf("stun: bad magic cookie")
+	}
+	if !bytesEqual(resp[8:20], txID) {
+		return netip.Addr{}, fmt.Errorf("stun: transaction ID mismatch")
+	}
+	if stunHeaderLen+int(msgLen) > len(resp) {
+		return netip.Addr{}, fmt.Errorf("stun: truncated message")
+	}
+
+	attrs := resp[stunHeaderLen : stunHeaderLen+int(msgLen)]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		padded := (attrLen + 3) &^ 3
+		if 4+padded > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		if attrType == stunAttrXorMappedAddress {
+			return parseXorMappedAddress(value, resp[8:20])
+		}
+		attrs = attrs[4+padded:]
+	}
+	return netip.Addr{}, fmt.Errorf("stun: no XOR-MAPPED-ADDRESS attribute in response")
+}
+
+// parseXorMappedAddress decodes the address of the XOR-MAPPED-ADDRESS
+// attribute value per RFC 5389 section 15.2: the address is XORed with
+// the magic cookie (IPv4) or the magic cookie followed by the transaction
+// ID (IPv6). The X-Port field is not decoded and the port is not returned.
+func parseXorMappedAddress(value, txID []byte) (netip.Addr, error) {
+	if len(value) < 4 {
+		return netip.Addr{}, fmt.Errorf("stun: short XOR-MAPPED-ADDRESS attribute")
+	}
+	family := value[1]
+	var cookie [16]byte
+	binary.BigEndian.PutUint32(cookie[0:4], stunMagicCookie)
+	copy(cookie[4:16], txID)
+
+	switch family {
+	case stunFamilyIPv4:
+		if len(value) < 8 {
+			return netip.Addr{}, fmt.Errorf("stun: short IPv4 XOR-MAPPED-ADDRESS attribute")
+		}
+		var b [4]byte
+		for i := range b {
+			b[i] = value[4+i] ^ cookie[i]
+		}
+		return netip.AddrFrom4(b), nil
+	case stunFamilyIPv6:
+		if len(value) < 20 {
+			return netip.Addr{}, fmt.Errorf("stun: short IPv6 XOR-MAPPED-ADDRESS attribute")
+		}
+		var b [16]byte
+		for i := range b {
+			b[i] = value[4+i] ^ cookie[i]
+		}
+		return netip.AddrFrom16(b), nil
+	default:
+		return netip.Addr{}, fmt.Errorf("stun: unknown address family 0x%02x", family)
+	}
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func stunResolvers(family Family) []Resolver {
+	resolvers := make([]Resolver, len(stunServers))
+	for i, server := range stunServers {
+		resolvers[i] = STUNResolver{Server: server, Family: family}
+	}
+	return resolvers
+}
+
+// STUNFamily queries a pool of public STUN servers for the given family
+// and returns the address on which a quorum of them agrees. It works as a
+// NAT-traversal-aware third source alongside DNSFamily and HTTPFamily,
+// and can succeed where outbound DNS or HTTP is filtered.
+func STUNFamily(family Family) string {
+	c := &Consensus{Resolvers: stunResolvers(family), Timeout: defaultTimeout}
+	addr, _ := c.Resolve(context.Background())
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.String()
+}
+
+// STUN queries a pool of public STUN servers over IPv4 and returns the
+// address on which a quorum of them agrees.
+func STUN() string {
+	return STUNFamily(FamilyIPv4)
+}
+
+// AllConsensusFamily builds a single Consensus spanning the default DNS,
+// HTTP and STUN resolvers for family. Its strict-majority quorum is
+// counted over all of them together, not per transport, so agreement
+// within each transport is not required: for IPv4 the 18 HTTP resolvers
+// alone outnumber the other 6 and can reach quorum on their own.
+func AllConsensusFamily(family Family) *Consensus {
+	var resolvers []Resolver
+	resolvers = append(resolvers, dnsResolvers(family)...)
+	resolvers = append(resolvers, httpResolvers(family)...)
+	resolvers = append(resolvers, stunResolvers(family)...)
+	return &Consensus{Resolvers: resolvers, Timeout: defaultTimeout}
+}
+
+// All queries the default DNS, HTTP and STUN resolvers over IPv4 together
+// and returns the address on which a strict majority of all of them
+// agrees, as built by AllConsensusFamily.
+func All() string {
+	addr, _ := AllConsensusFamily(FamilyIPv4).Resolve(context.Background())
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,108 @@
+package externalip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// Canned STUN Binding Success Responses built by hand around the RFC 5769
+// section 2.1 transaction ID: the IPv4 XOR-MAPPED-ADDRESS attribute is the
+// one of section 2.2 (192.0.2.1), the IPv6 one encodes 2001:db8::1 with the
+// same transaction ID, so a byte-offset or magic-cookie slip in the parser
+// shows up as a test failure rather than silently returning a garbage
+// address.
+var stunTxID = []byte{0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae}
+
+// concatBytes joins byte slices without the nesting of repeated append calls.
+func concatBytes(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func TestParseStunBindingResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    []byte
+		want    netip.Addr
+		wantErr bool
+	}{
+		{
+			name: "ipv4 success",
+			resp: concatBytes(
+				[]byte{0x01, 0x01, 0x00, 0x0c}, // type=Binding Success, length=12
+				[]byte{0x21, 0x12, 0xa4, 0x42}, // magic cookie
+				stunTxID,
+				[]byte{0x00, 0x20, 0x00, 0x08}, // XOR-MAPPED-ADDRESS, length=8
+				[]byte{0x00, 0x01, 0xa1, 0x47}, // family=IPv4, X-Port
+				[]byte{0xe1, 0x12, 0xa6, 0x43}, // X-Address
+			),
+			want: netip.MustParseAddr("192.0.2.1"),
+		},
+		{
+			name: "ipv6 success",
+			resp: concatBytes(
+				[]byte{0x01, 0x01, 0x00, 0x18}, // type=Binding Success, length=24
+				[]byte{0x21, 0x12, 0xa4, 0x42}, // magic cookie
+				stunTxID,
+				[]byte{0x00, 0x20, 0x00, 0x14}, // XOR-MAPPED-ADDRESS, length=20
+				[]byte{0x00, 0x02, 0xa1, 0x47}, // family=IPv6, X-Port
+				[]byte{0x01, 0x13, 0xa9, 0xfa, 0xb7, 0xe7, 0xa7, 0x01, // X-Address
+					0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xaf},
+			),
+			want: netip.MustParseAddr("2001:db8::1"),
+		},
+		{
+			name:    "short response",
+			resp:    []byte{0x01, 0x01, 0x00, 0x00},
+			wantErr: true,
+		},
+		{
+			name: "bad magic cookie",
+			resp: concatBytes(
+				[]byte{0x01, 0x01, 0x00, 0x00},
+				[]byte{0xde, 0xad, 0xbe, 0xef},
+				stunTxID,
+			),
+			wantErr: true,
+		},
+		{
+			name: "transaction ID mismatch",
+			resp: concatBytes(
+				[]byte{0x01, 0x01, 0x00, 0x00},
+				[]byte{0x21, 0x12, 0xa4, 0x42},
+				make([]byte, 12),
+			),
+			wantErr: true,
+		},
+		{
+			name: "no xor-mapped-address attribute",
+			resp: concatBytes(
+				[]byte{0x01, 0x01, 0x00, 0x00},
+				[]byte{0x21, 0x12, 0xa4, 0x42},
+				stunTxID,
+			),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStunBindingResponse(tt.resp, stunTxID)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseStunBindingResponse() = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseStunBindingResponse() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("parseStunBindingResponse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
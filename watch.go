@@ -0,0 +1,138 @@
+package externalip
+
+import (
+	"context"
+	"math/rand"
+	"net/netip"
+	"time"
+)
+
+// Event describes a change in the external address observed by Watch.
+type Event struct {
+	Old, New netip.Addr
+	At       time.Time
+	Family   Family
+}
+
+// WatchOptions configures Watch and WatchFunc.
+type WatchOptions struct {
+	// MinStable requires this many consecutive identical results before
+	// a change is reported, to suppress flapping between two addresses
+	// seen in quick succession. Zero and one both mean "report as soon
+	// as seen once".
+	MinStable int
+	// Resolve is called once per interval to obtain the current address
+	// for the family being watched. Defaults to DNSFamily falling back
+	// to HTTPFamily when nil.
+	Resolve func(family Family) string
+}
+
+// Watch periodically resolves the external address for family and sends
+// an Event on the returned channel whenever it changes, until ctx is
+// cancelled, at which point the channel is closed. This is the primary
+// use case for this package - DDNS updaters, VPN reconnection, firewall
+// rule regeneration - so callers no longer need to build their own
+// polling loop around DNSFamily/HTTPFamily.
+//
+// The initial observation establishes a baseline silently, without
+// producing an Event, since nothing has actually changed yet; only a
+// later resolve that disagrees with that baseline fires one.
+//
+// A cycle that fails to resolve any address is retried with jittered
+// exponential backoff capped at interval, rather than reporting a change.
+func Watch(ctx context.Context, family Family, interval time.Duration, opts WatchOptions) <-chan Event {
+	resolve := opts.Resolve
+	if resolve == nil {
+		resolve = familyResult
+	}
+	minStable := opts.MinStable
+	if minStable < 1 {
+		minStable = 1
+	}
+
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+
+		minBackoff := interval / 8
+		if minBackoff <= 0 {
+			minBackoff = time.Second
+		}
+
+		var current, stableAddr netip.Addr
+		stableCount := 0
+		backoff := minBackoff
+		discovered := false
+
+		for {
+			if addr, err := netip.ParseAddr(resolve(family)); err == nil {
+				backoff = minBackoff
+
+				if addr == stableAddr {
+					stableCount++
+				} else {
+					stableAddr = addr
+					stableCount = 1
+				}
+
+				if !discovered {
+					// First successful resolve establishes the baseline;
+					// it is not a change, so no Event is sent for it.
+					if stableCount >= minStable {
+						current = addr
+						discovered = true
+					}
+				} else if stableCount >= minStable && addr != current {
+					select {
+					case ch <- Event{Old: current, New: addr, At: time.Now(), Family: family}:
+						current = addr
+					case <-ctx.Done():
+						return
+					}
+				}
+
+				if !sleep(ctx, interval) {
+					return
+				}
+				continue
+			}
+
+			// Total failure this cycle: back off, capped at interval,
+			// with jitter to avoid synchronized retries across watchers.
+			if !sleep(ctx, jitter(backoff)) {
+				return
+			}
+			backoff *= 2
+			if backoff > interval {
+				backoff = interval
+			}
+		}
+	}()
+	return ch
+}
+
+// WatchFunc is like Watch but calls fn for every Event instead of
+// returning a channel, blocking until ctx is cancelled.
+func WatchFunc(ctx context.Context, family Family, interval time.Duration, opts WatchOptions, fn func(Event)) {
+	for ev := range Watch(ctx, family, interval, opts) {
+		fn(ev)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// jitter returns d scaled by a random factor in [0.8, 1.2) so that many
+// watchers backing off at once don't retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (0.8 + rand.Float64()*0.4))
+}